@@ -1,39 +1,280 @@
-const ICECAST_SERVERS = [
-  { hostName: 'icecast.zuidwestfm.nl', port: 80, username: 'admin', password: 'hackme', mountPoint: '/zuidwest.mp3' },
-  { hostName: 'icecast.zuidwestfm.nl', port: 80, username: 'admin', password: 'hackme', mountPoint: '/zuidwest.aac' }
-  // Add more servers if needed
+const STREAM_SERVERS = [
+  { hostName: 'icecast.zuidwestfm.nl', port: 80, username: 'admin', password: 'hackme', mountPoints: ['/zuidwest.mp3', '/zuidwest.aac'] }
+  // Add more servers if needed, Shoutcast servers use type 'shoutcast' (v1) or 'shoutcast2' with the stream 'sid':
+  // { type: 'shoutcast2', hostName: 'shoutcast.zuidwestfm.nl', port: 8000, username: 'admin', password: 'hackme', sid: 1, timeout: 30000 }
+  // Failures during a maintenance window are logged without an error or notification, the next run after it pushes the song again:
+  // { ..., maintenance: [{ start: '2026-10-20T02:00:00+02:00', end: '2026-10-20T04:00:00+02:00' }] }
 ]
 
+// 'all' pushes to every server, 'first' stops at the first server that accepts the update (list the primary first, then the backups)
+// With 'first' only the last server is retried, so failing over to a backup waits one request timeout instead of all retries
+const UPDATE_POLICY = 'all'
+
+// Maximum number of servers updated at the same time and the timeout per request in milliseconds, servers can override it with 'timeout'
+const MAX_CONCURRENT_REQUESTS = 4
+const REQUEST_TIMEOUT = 10000
+
+// Failed pushes are retried with exponential backoff and jitter, Retry-After from the server is honoured up to RETRY_MAX_DELAY
+// No retry is started, waited for or kept running past RETRY_TTL after the start of the run, keep it below the cron interval so a late retry can't overwrite the next run's song
+const MAX_ATTEMPTS = 3
+const RETRY_BASE_DELAY = 1000
+const RETRY_MAX_DELAY = 10000
+const RETRY_TTL = 45000
+
+// ntfy.sh topic that gets a push notification when updates fail, leave empty to disable
+// The worker keeps no state between runs, so an ongoing outage sends a notification on every cron run
+const NTFY_TOPIC = ''
+
+// Identification sent with every request, servers can add their own headers with a 'headers' object
+const REQUEST_HEADERS = {
+  'User-Agent': 'zwfm-metadata/1.0 (+https://github.com/oszuidwest/zwfm-metadata)',
+  'X-Station': 'zuidwest'
+}
+
 export default {
   async scheduled (event, env, ctx) {
     // Fetch current playing song
-    const response = await fetch('https://rds.zuidwestfm.nl/')
-    const song = await response.text()
+    let song, fallback
+    try {
+      ({ song, fallback } = await fetchSong())
+    } catch (error) {
+      const message = `Error fetching current song: ${error.message}`
+      console.error(message)
+      await notify(message)
+      return
+    }
+
+    // The RDS worker sends its fallback text when the broadcast data is unavailable, push it but alert about the outage
+    if (fallback) {
+      const message = `Current song unavailable, pushing fallback text: ${song}`
+      console.error(message)
+      await notify(message)
+    }
+
+    // Push to Icecast and Shoutcast servers
+    checkMaintenanceWindows(STREAM_SERVERS)
+    const retryDeadline = Date.now() + RETRY_TTL
+    const { results, updated } = UPDATE_POLICY === 'first'
+      ? await pushSequential(STREAM_SERVERS, song, retryDeadline)
+      : await pushAll(STREAM_SERVERS, song, retryDeadline)
 
-    // Push to Icecast servers
     const errors = []
-    for (const server of ICECAST_SERVERS) {
-      const metadata = { song, mount: server.mountPoint, mode: 'updinfo', charset: 'UTF-8' }
-      const requestOptions = {
-        method: 'GET',
-        headers: {
-          Authorization: 'Basic ' + btoa(server.username + ':' + server.password)
-        }
+    for (const { server, error, maintenance } of results) {
+      console.log(`${serverName(server)}: ${error || 'OK'}${error && maintenance ? ' (maintenance)' : ''}`)
+      if (error && !maintenance) {
+        errors.push(`${error} on ${serverName(server)}`)
       }
+    }
+
+    if (!updated && errors.length > 0) {
+      const message = 'One or more requests failed: \n' + errors.join('\n')
+      console.error(message)
+      await notify(message)
+      return
+    }
+
+    if (updated) {
+      console.log('Updated song metadata')
+    } else if (results.some(result => !result.error)) {
+      console.log('Updated song metadata, except on servers in maintenance')
+    } else {
+      console.log('Song metadata not updated, all failing servers are in maintenance')
+    }
+  }
+}
+
+// Function to fetch the current song and whether it is the RDS worker's fallback text, throws when the RDS worker is unreachable or returns an error
+async function fetchSong () {
+  const response = await fetch('https://rds.zuidwestfm.nl/', { headers: REQUEST_HEADERS })
+  if (!response.ok) {
+    throw new Error(`${response.status} ${response.statusText}`)
+  }
+  return { song: await response.text(), fallback: response.headers.has('X-Fallback') }
+}
+
+// Function to push to all servers, the update succeeds when every mount point accepted it
+async function pushAll (servers, song, retryDeadline) {
+  const results = await pushParallel(expandMountPoints(servers), song, retryDeadline)
+  return { results, updated: results.every(result => !result.error) }
+}
+
+// Function to push to servers in order until one accepts the update on all its mount points
+async function pushSequential (servers, song, retryDeadline) {
+  const results = []
+  for (const [index, server] of servers.entries()) {
+    const attempts = index < servers.length - 1 ? 1 : MAX_ATTEMPTS
+    const serverResults = await pushParallel(expandMountPoints([server]), song, retryDeadline, attempts)
+    results.push(...serverResults)
+    if (serverResults.every(result => !result.error)) {
+      return { results, updated: true }
+    }
+  }
+  return { results, updated: false }
+}
+
+// Function to push to all servers in parallel, with at most MAX_CONCURRENT_REQUESTS requests in flight
+// Servers in maintenance get a single attempt, as failures are expected there
+async function pushParallel (servers, song, retryDeadline, attempts = MAX_ATTEMPTS) {
+  const results = []
+  let next = 0
+  const workers = Array.from({ length: Math.min(MAX_CONCURRENT_REQUESTS, servers.length) }, async () => {
+    while (next < servers.length) {
+      const index = next++
+      const server = servers[index]
+      const maintenance = inMaintenance(server)
+      const error = await pushToServer(server, song, retryDeadline, maintenance ? 1 : attempts)
+      results[index] = { server, error, maintenance }
+    }
+  })
+  await Promise.all(workers)
+  return results
+}
+
+// Function to split servers with a list of mount points into one entry per mount point
+// An empty list keeps the server as one entry, so pushToServer reports it as a config error instead of it counting as updated
+function expandMountPoints (servers) {
+  return servers.flatMap(server => server.mountPoints?.length
+    ? server.mountPoints.map(mountPoint => ({ ...server, mountPoint }))
+    : [server])
+}
+
+// Function to push the song to a single server with up to the given number of attempts, retries stop at the retry deadline, returns an error message or null on success
+async function pushToServer (server, song, retryDeadline, attempts = MAX_ATTEMPTS) {
+  if (server.mountPoints?.length === 0) {
+    return '[config] Error: mountPoints is empty'
+  }
+
+  const { url, headers } = createUpdateRequest(server, song)
+  let error = null
 
-      const url = `http://${server.hostName}:${server.port}/admin/metadata.xsl?` + new URLSearchParams(metadata)
+  for (let attempt = 1; attempt <= attempts; attempt++) {
+    const timeout = server.timeout || REQUEST_TIMEOUT
+    const requestOptions = {
+      method: 'GET',
+      signal: AbortSignal.timeout(attempt === 1 ? timeout : Math.min(timeout, retryDeadline - Date.now())),
+      headers: {
+        ...REQUEST_HEADERS,
+        ...server.headers,
+        ...headers
+      }
+    }
+
+    let retryAfter = 0
+    try {
       const serverResponse = await fetch(url, requestOptions)
+      if (serverResponse.ok) {
+        return null
+      }
 
-      if (!serverResponse.ok) {
-        errors.push(`Error ${serverResponse.status}: ${serverResponse.statusText} on ${server.hostName}`)
+      error = `[${statusErrorCode(serverResponse.status)}] Error ${serverResponse.status}: ${serverResponse.statusText}`
+      // Other client errors such as bad credentials won't succeed on a retry
+      if (serverResponse.status !== 429 && serverResponse.status < 500) {
+        return error
       }
+      retryAfter = (Number(serverResponse.headers.get('Retry-After')) || 0) * 1000
+    } catch (fetchError) {
+      error = `[${fetchError.name === 'TimeoutError' ? 'timeout' : 'network'}] Error: ${fetchError.message}`
     }
 
-    if (errors.length > 0) {
-      console.error('One or more requests failed: \n' + errors.join('\n'))
-      return
+    if (attempt < attempts) {
+      const delay = Math.min(retryAfter || retryDelay(attempt), RETRY_MAX_DELAY)
+      if (Date.now() + delay >= retryDeadline) {
+        break
+      }
+      await sleep(delay)
     }
+  }
+
+  return error
+}
+
+// Function to map an HTTP status to an error code, so alerts can tell bad credentials from a target that is down
+function statusErrorCode (status) {
+  if (status === 401 || status === 403) {
+    return 'auth'
+  }
+  if (status === 429) {
+    return 'throttled'
+  }
+  return status < 500 ? 'client' : 'server'
+}
+
+// Function to calculate the exponential backoff with jitter for an attempt
+function retryDelay (attempt) {
+  return RETRY_BASE_DELAY * 2 ** (attempt - 1) * (0.5 + Math.random() / 2)
+}
+
+// Function to wait for the given number of milliseconds
+function sleep (ms) {
+  return new Promise(resolve => setTimeout(resolve, ms))
+}
+
+// Function to build the metadata update request for the server type
+function createUpdateRequest (server, song) {
+  const baseUrl = `http://${server.hostName}:${server.port}`
+
+  switch (server.type) {
+    case 'shoutcast':
+      // Shoutcast v1 only accepts admin requests from Mozilla user agents
+      return {
+        url: `${baseUrl}/admin.cgi?` + new URLSearchParams({ pass: server.password, mode: 'updinfo', song }),
+        headers: { 'User-Agent': 'Mozilla/5.0 (compatible; zwfm-metadata/1.0)' }
+      }
+    case 'shoutcast2':
+      return {
+        url: `${baseUrl}/admin.cgi?` + new URLSearchParams({ sid: server.sid || 1, mode: 'updinfo', song }),
+        headers: { Authorization: 'Basic ' + btoa(server.username + ':' + server.password) }
+      }
+    default:
+      return {
+        url: `${baseUrl}/admin/metadata.xsl?` + new URLSearchParams({ song, mount: server.mountPoint, mode: 'updinfo', charset: 'UTF-8' }),
+        headers: { Authorization: 'Basic ' + btoa(server.username + ':' + server.password) }
+      }
+  }
+}
+
+// Function to check whether a server is inside one of its maintenance windows
+function inMaintenance (server) {
+  const now = Date.now()
+  return (server.maintenance || []).some(window => now >= Date.parse(window.start) && now < Date.parse(window.end))
+}
+
+// Function to log maintenance windows with dates that can't be parsed, inMaintenance ignores those
+function checkMaintenanceWindows (servers) {
+  for (const server of servers) {
+    for (const window of server.maintenance || []) {
+      if (isNaN(Date.parse(window.start)) || isNaN(Date.parse(window.end))) {
+        console.error(`Misconfigured maintenance window on ${serverName(server)}: ${JSON.stringify(window)}`)
+      }
+    }
+  }
+}
+
+// Function to describe a server in log lines
+function serverName (server) {
+  return server.type === 'shoutcast2'
+    ? `${server.hostName} (sid ${server.sid || 1})`
+    : `${server.hostName}${server.mountPoint || ''}`
+}
+
+// Function to send a push notification to the technician on call
+async function notify (message) {
+  if (!NTFY_TOPIC) {
+    return
+  }
 
-    console.log('Updated song metadata')
+  try {
+    await fetch(`https://ntfy.sh/${NTFY_TOPIC}`, {
+      method: 'POST',
+      headers: {
+        ...REQUEST_HEADERS,
+        Title: 'Stream metadata update failed',
+        Priority: 'high',
+        Tags: 'warning'
+      },
+      body: message
+    })
+  } catch (error) {
+    console.error(`Error sending notification: ${error.message}`)
   }
 }
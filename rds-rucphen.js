@@ -1,3 +1,12 @@
+// Identification sent with requests to the Rucphen RTV website
+const REQUEST_HEADERS = {
+  'User-Agent': 'zwfm-metadata/1.0 (+https://github.com/oszuidwest/zwfm-metadata)',
+  'X-Station': 'rucphen'
+}
+
+// Text sent when no programme is scheduled or the schedule can't be read
+const FALLBACK_TEXT = 'Rucphen RTV'
+
 addEventListener('fetch', event => {
   event.respondWith(handleRequest(event.request))
 })
@@ -7,7 +16,7 @@ async function handleRequest (request) {
 
   try {
     // Fetch the HTML content from the URL
-    const response = await fetch(url)
+    const response = await fetch(url, { headers: REQUEST_HEADERS })
     const html = await response.text()
 
     // Decode HTML entities in the fetched HTML
@@ -31,7 +40,7 @@ async function handleRequest (request) {
 
     if (!dayMatch) {
       console.log('Schedule section not found for today.')
-      return new Response('Error: Unable to find the schedule for today.', { status: 500 })
+      return createFallbackResponse()
     }
 
     // Extract the schedule for the current day
@@ -46,7 +55,7 @@ async function handleRequest (request) {
     // Regular expression to find program entries
     const programRegex = /(\d{2}:\d{2})\s*–\s*(\d{2}:\d{2})\s*\|\s*([^<\n\r]*)/g
     let match
-    let currentProgramName = 'No program scheduled for the current time.'
+    let currentProgramName = null
 
     while ((match = programRegex.exec(decodedScheduleHtml)) !== null) {
       const startTime = match[1]
@@ -81,6 +90,11 @@ async function handleRequest (request) {
       }
     }
 
+    if (!currentProgramName) {
+      console.log('No program scheduled for the current time.')
+      return createFallbackResponse()
+    }
+
     return new Response(currentProgramName, {
       status: 200,
       headers: {
@@ -89,10 +103,21 @@ async function handleRequest (request) {
     })
   } catch (error) {
     console.log(`Error: ${error.message}`)
-    return new Response(`Error: ${error.message}`, { status: 500 })
+    return createFallbackResponse()
   }
 }
 
+// Function to send the fallback text, marked so consumers can tell it apart from a scheduled programme
+function createFallbackResponse () {
+  return new Response(FALLBACK_TEXT, {
+    status: 200,
+    headers: {
+      'Content-Type': 'text/plain; charset=UTF-8',
+      'X-Fallback': '1'
+    }
+  })
+}
+
 // Function to decode HTML entities
 function decodeHtmlEntities (str) {
   const entities = {
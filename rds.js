@@ -1,3 +1,18 @@
+// Browser and CDN cache lifetime in seconds, only sent to clients so the edge cache keeps its hourly entry
+const CACHE_MAX_AGE = 60
+
+// Text sent when the broadcast data has no programme service or radio text
+const FALLBACK_TEXT = { ps: 'ZuidWest', rt: 'ZuidWest FM' }
+
+// Edge cache lifetime in seconds for the fallback when the broadcast data API is unavailable
+const FALLBACK_CACHE_MAX_AGE = 60
+
+// Identification sent with requests to the broadcast data API
+const REQUEST_HEADERS = {
+  'User-Agent': 'zwfm-metadata/1.0 (+https://github.com/oszuidwest/zwfm-metadata)',
+  'X-Station': 'zuidwest'
+}
+
 // Adding the "fetch" event listener
 addEventListener('fetch', (event) => {
   event.respondWith(handleRequest(event.request, event))
@@ -5,19 +20,38 @@ addEventListener('fetch', (event) => {
 
 // Asynchronous function to handle requests
 async function handleRequest (request, event) {
-  const { cacheUrl, cacheBusterValue } = addCacheBuster(new URL(request.url))
+  if (request.method === 'OPTIONS') {
+    return handleOptions(request)
+  }
+
+  // JSONP requests share the cache entry of the plain text response
+  const url = new URL(request.url)
+  const callback = url.searchParams.get('callback')
+  url.searchParams.delete('callback')
+
+  const { cacheUrl, cacheBusterValue } = addCacheBuster(url)
   const cache = caches.default
 
   let response = await cache.match(cacheUrl)
   let headers = new Headers({
     'Content-Type': 'text/plain; charset=utf-8',
     'X-Robots-Tag': 'noindex, nofollow, noarchive',
+    'Access-Control-Allow-Origin': '*',
     'X-Cache-Buster': cacheBusterValue // Add cache buster for debugging
   })
 
   if (!response) {
     const data = await fetchBroadcastData()
-    const content = extractContent(new URL(request.url), data)
+    let content = extractContent(new URL(request.url), data)
+    // Mark the fallback so consumers like push.js can tell it apart from real broadcast data
+    if (!content) {
+      content = url.searchParams.has('ps') ? FALLBACK_TEXT.ps : FALLBACK_TEXT.rt
+      headers.set('X-Fallback', '1')
+    }
+    headers.set('ETag', await createETag(content))
+    if (!data) {
+      headers.set('Cache-Control', `max-age=${FALLBACK_CACHE_MAX_AGE}`)
+    }
 
     response = new Response(content, {
       status: 200,
@@ -30,6 +64,18 @@ async function handleRequest (request, event) {
     headers = new Headers(response.headers)
     headers.append('X-Cache-Status', 'Hit')
   }
+  headers.set('Cache-Control', `public, max-age=${CACHE_MAX_AGE}`)
+
+  if (callback) {
+    return createJsonpResponse(callback, await response.text(), headers)
+  }
+
+  if (matchesETag(request.headers.get('If-None-Match'), headers.get('ETag'))) {
+    return new Response(null, {
+      status: 304,
+      headers
+    })
+  }
 
   return new Response(response.body, {
     status: response.status,
@@ -37,6 +83,33 @@ async function handleRequest (request, event) {
   })
 }
 
+// Function to answer CORS preflight requests
+function handleOptions (request) {
+  return new Response(null, {
+    status: 204,
+    headers: {
+      'Access-Control-Allow-Origin': '*',
+      'Access-Control-Allow-Methods': 'GET, OPTIONS',
+      'Access-Control-Allow-Headers': request.headers.get('Access-Control-Request-Headers') || '*',
+      'Access-Control-Max-Age': '86400'
+    }
+  })
+}
+
+// Function to wrap the content in a JSONP callback for legacy widgets
+function createJsonpResponse (callback, content, headers) {
+  if (!/^[A-Za-z_$][\w$.]*$/.test(callback)) {
+    return new Response('Invalid callback', { status: 400 })
+  }
+
+  headers.set('Content-Type', 'application/javascript; charset=utf-8')
+  headers.delete('ETag')
+  return new Response(`/**/${callback}(${JSON.stringify(content)})`, {
+    status: 200,
+    headers
+  })
+}
+
 // Function to add a cache buster to the URL
 function addCacheBuster (url) {
   const amsterdamTime = new Date().toLocaleString('en-US', {
@@ -52,16 +125,43 @@ function addCacheBuster (url) {
   }
 }
 
-// Asynchronous function to fetch broadcast data
+// Asynchronous function to fetch broadcast data, returns null when the API is unavailable
 async function fetchBroadcastData () {
-  const response = await fetch('https://www.zuidwestupdate.nl/wp-json/zw/v1/broadcast_data')
-  return response.json()
+  try {
+    const response = await fetch('https://www.zuidwestupdate.nl/wp-json/zw/v1/broadcast_data', { headers: REQUEST_HEADERS })
+    if (!response.ok) {
+      console.error(`Error ${response.status}: ${response.statusText} fetching broadcast data`)
+      return null
+    }
+    return await response.json()
+  } catch (error) {
+    console.error(`Error fetching broadcast data: ${error.message}`)
+    return null
+  }
 }
 
-// Function to extract content from json
+// Function to extract content from json, returns null when there is no text
 function extractContent (url, data) {
   const text = url.searchParams.has('ps')
-    ? data.fm.rds.program
-    : data.fm.rds.radiotext
-  return text.replace(/<[^>]*>?/gm, '')
+    ? data?.fm?.rds?.program
+    : data?.fm?.rds?.radiotext
+  const content = (text || '').replace(/<[^>]*>?/gm, '')
+  return content.trim() ? content : null
+}
+
+// Function to create an ETag from the response content
+async function createETag (content) {
+  const digest = await crypto.subtle.digest('SHA-1', new TextEncoder().encode(content))
+  const hash = [...new Uint8Array(digest)].map(byte => byte.toString(16).padStart(2, '0')).join('')
+  return `"${hash}"`
+}
+
+// Function to check If-None-Match against the ETag, allowing lists, * and tags weakened by compression
+function matchesETag (ifNoneMatch, etag) {
+  if (!ifNoneMatch || !etag) {
+    return false
+  }
+
+  const strip = tag => tag.trim().replace(/^W\//, '')
+  return ifNoneMatch.split(',').some(tag => tag.trim() === '*' || strip(tag) === strip(etag))
 }